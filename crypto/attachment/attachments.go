@@ -7,12 +7,18 @@
 package attachment
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"hash"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 var (
@@ -29,11 +35,47 @@ const (
 	ivLength   = 16
 )
 
-var (
-	keyBase64Length  = base64.RawURLEncoding.EncodedLen(keyLength)
-	hashBase64Length = base64.RawStdEncoding.EncodedLen(hashLength)
-	ivBase64Length   = base64.RawStdEncoding.EncodedLen(ivLength)
-)
+// base64Alphabets are tried in order when decoding v1 attachments, whose
+// iv/hashes.sha256/key.k fields are sometimes found encoded with padding
+// and/or the URL-safe alphabet instead of the raw-standard/raw-url
+// combination that NewEncryptedFile emits.
+var base64Alphabets = []*base64.Encoding{
+	base64.RawStdEncoding,
+	base64.StdEncoding,
+	base64.RawURLEncoding,
+	base64.URLEncoding,
+}
+
+// decodeFlexible decodes s into length bytes, trying preferred first and
+// falling back to every other known base64 alphabet. This lets Decrypt
+// accept the more permissive encodings seen in archived v1 attachments
+// while NewEncryptedFile/Encrypt keep emitting the strict v2 encoding.
+func decodeFlexible(s string, preferred *base64.Encoding, length int) ([]byte, error) {
+	if out, err := decodeExact(s, preferred, length); err == nil {
+		return out, nil
+	}
+	for _, enc := range base64Alphabets {
+		if enc == preferred {
+			continue
+		}
+		if out, err := decodeExact(s, enc, length); err == nil {
+			return out, nil
+		}
+	}
+	return nil, errors.New("no matching base64 alphabet")
+}
+
+// decodeExact decodes s with enc and requires the result to be exactly
+// length bytes, since a strict size check is what used to guard against
+// garbage input here.
+func decodeExact(s string, enc *base64.Encoding, length int) ([]byte, error) {
+	buf := make([]byte, enc.DecodedLen(len(s)))
+	n, err := enc.Decode(buf, []byte(s))
+	if err != nil || n != length {
+		return nil, errors.New("base64 decode did not produce the expected length")
+	}
+	return buf[:n], nil
+}
 
 type JSONWebKey struct {
 	Key         string   `json:"k"`
@@ -78,66 +120,273 @@ func NewEncryptedFile() *EncryptedFile {
 	}
 }
 
+// NewEncryptedFileFromMaster deterministically derives a Matrix v2 attachment
+// key+IV from a caller-managed master secret via HKDF-SHA256, the same
+// construction Matrix clients already use to derive Megolm/backup keys. This
+// lets a client encrypt many attachments in a room from a single stored
+// secret instead of generating and persisting a fresh JWK+IV per attachment;
+// recipients still decrypt the result exactly like any other v2 attachment.
+//
+// info MUST be unique per attachment (e.g. a room ID + event ID + attachment
+// index) -- deriving from the same master+info pair twice produces the same
+// key and IV and breaks CTR mode's security. If IVReuseCheck is enabled,
+// reuse of a master+info pair that is among the last ivReuseCacheSize pairs
+// seen in this process panics instead of silently producing a reused key
+// stream; reuse of an older pair is not detected.
+func NewEncryptedFileFromMaster(master []byte, info []byte) *EncryptedFile {
+	checkIVReuse(master, info)
+
+	var key [keyLength]byte
+	var iv [ivLength]byte
+	r := hkdf.New(sha256.New, master, nil, info)
+	if _, err := io.ReadFull(r, key[:]); err != nil {
+		panic(err)
+	}
+	// As in genA256CTR, only the first 8 bytes of the 16-byte IV are filled;
+	// the last 8 stay zero.
+	if _, err := io.ReadFull(r, iv[:8]); err != nil {
+		panic(err)
+	}
+
+	return &EncryptedFile{
+		Key: JSONWebKey{
+			Key:         base64.RawURLEncoding.EncodeToString(key[:]),
+			Algorithm:   "A256CTR",
+			Extractable: true,
+			KeyType:     "oct",
+			KeyOps:      []string{"encrypt", "decrypt"},
+		},
+		InitVector: base64.RawStdEncoding.EncodeToString(iv[:]),
+		Version:    "v2",
+
+		decoded: &decodedKeys{key, iv},
+	}
+}
+
+// IVReuseCheck enables an in-memory guard against calling
+// NewEncryptedFileFromMaster with the same master+info pair twice in this
+// process. It's disabled by default because it retains fingerprints of the
+// most recent ivReuseCacheSize master+info pairs seen (the oldest is dropped
+// once that bound is exceeded); turn it on in development or tests to catch
+// accidental info reuse before it ships.
+var IVReuseCheck = false
+
+const ivReuseCacheSize = 4096
+
+var (
+	ivReuseMu    sync.Mutex
+	ivReuseSeen  = make(map[[sha256.Size]byte]struct{}, ivReuseCacheSize)
+	ivReuseOrder [][sha256.Size]byte
+)
+
+func checkIVReuse(master, info []byte) {
+	if !IVReuseCheck {
+		return
+	}
+	h := sha256.New()
+	h.Write(master)
+	h.Write([]byte{0})
+	h.Write(info)
+	var fingerprint [sha256.Size]byte
+	h.Sum(fingerprint[:0])
+
+	ivReuseMu.Lock()
+	defer ivReuseMu.Unlock()
+	if _, ok := ivReuseSeen[fingerprint]; ok {
+		panic("attachment: master+info pair reused in NewEncryptedFileFromMaster, this would reuse an IV")
+	}
+	ivReuseSeen[fingerprint] = struct{}{}
+	ivReuseOrder = append(ivReuseOrder, fingerprint)
+	if len(ivReuseOrder) > ivReuseCacheSize {
+		delete(ivReuseSeen, ivReuseOrder[0])
+		ivReuseOrder = ivReuseOrder[1:]
+	}
+}
 
 func (ef *EncryptedFile) decodeKeys() error {
 	if ef.decoded != nil {
 		return nil
-	} else if len(ef.Key.Key) != keyBase64Length {
-		return InvalidKey
-	} else if len(ef.InitVector) != ivBase64Length {
-		return InvalidInitVector
 	}
-	ef.decoded = &decodedKeys{}
-	_, err := base64.RawURLEncoding.Decode(ef.decoded.key[:], []byte(ef.Key.Key))
+	key, err := decodeFlexible(ef.Key.Key, base64.RawURLEncoding, keyLength)
 	if err != nil {
 		return InvalidKey
 	}
-	_, err = base64.RawStdEncoding.Decode(ef.decoded.iv[:], []byte(ef.InitVector))
+	iv, err := decodeFlexible(ef.InitVector, base64.RawStdEncoding, ivLength)
 	if err != nil {
 		return InvalidInitVector
 	}
+	ef.decoded = &decodedKeys{}
+	copy(ef.decoded.key[:], key)
+	copy(ef.decoded.iv[:], iv)
 	return nil
 }
 
+// Encrypt is a thin wrapper around EncryptStream for callers that already
+// have the whole plaintext in memory.
 func (ef *EncryptedFile) Encrypt(plaintext []byte) []byte {
-	ef.decodeKeys()
-	ciphertext := xorA256CTR(plaintext, ef.decoded.key, ef.decoded.iv)
-	hash := sha256.Sum256(ciphertext)
-	ef.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString(hash[:])
-	return ciphertext
+	var ciphertext bytes.Buffer
+	w, err := ef.EncryptStream(&ciphertext)
+	if err != nil {
+		// EncryptStream only fails to decode keys that NewEncryptedFile and
+		// NewEncryptedFileFromMaster always produce correctly.
+		panic(err)
+	}
+	if _, err = w.Write(plaintext); err != nil {
+		panic(err)
+	}
+	if err = w.Close(); err != nil {
+		panic(err)
+	}
+	return ciphertext.Bytes()
+}
+
+// encryptStreamWriter wraps a cipher.StreamWriter so that the SHA-256 of the
+// produced ciphertext is recorded into the EncryptedFile when the writer is
+// closed.
+type encryptStreamWriter struct {
+	cipher.StreamWriter
+	ef   *EncryptedFile
+	hash hash.Hash
 }
 
-func (ef *EncryptedFile) checkHash(ciphertext []byte) bool {
-	if len(ef.Hashes.SHA256) != hashBase64Length {
-		return false
+func (w *encryptStreamWriter) Close() error {
+	sum := w.hash.Sum(nil)
+	w.ef.Hashes.SHA256 = base64.RawStdEncoding.EncodeToString(sum)
+	return w.StreamWriter.Close()
+}
+
+// EncryptStream returns an io.WriteCloser that encrypts everything written to
+// it and forwards the ciphertext to dst. The SHA-256 hash of the ciphertext
+// is only known once the whole plaintext has been written, so ef.Hashes.SHA256
+// is populated when the returned writer is closed, not before.
+func (ef *EncryptedFile) EncryptStream(dst io.Writer) (io.WriteCloser, error) {
+	if err := ef.decodeKeys(); err != nil {
+		return nil, err
 	}
-	var hash [hashLength]byte
-	_, err := base64.RawStdEncoding.Decode(hash[:], []byte(ef.Hashes.SHA256))
+	block, err := aes.NewCipher(ef.decoded.key[:])
 	if err != nil {
-		return false
+		return nil, err
 	}
-	return hash == sha256.Sum256(ciphertext)
+	h := sha256.New()
+	stream := cipher.NewCTR(block, ef.decoded.iv[:])
+	return &encryptStreamWriter{
+		StreamWriter: cipher.StreamWriter{S: stream, W: io.MultiWriter(dst, h)},
+		ef:           ef,
+		hash:         h,
+	}, nil
 }
 
+// checkVersion accepts "v2" as well as the pre-v2 Matrix attachment
+// encryption, which is either marked "v1" or has no version field at all.
+func (ef *EncryptedFile) checkVersion() error {
+	switch ef.Version {
+	case "v2", "v1", "":
+		return nil
+	default:
+		return UnsupportedVersion
+	}
+}
+
+// Decrypt is a thin wrapper around DecryptStream for callers that already
+// have the whole ciphertext in memory.
 func (ef *EncryptedFile) Decrypt(ciphertext []byte) ([]byte, error) {
-	if ef.Version != "v2" {
-		return nil, UnsupportedVersion
+	r, err := ef.DecryptStream(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// DecryptStream verifies the SHA-256 hash of src against ef.Hashes.SHA256 and
+// then returns a reader that decrypts the ciphertext. Because the hash has to
+// be checked before any plaintext is returned, src is read in full once to
+// verify the hash and then rewound with Seek, which is why this requires an
+// io.ReadSeeker rather than a plain io.Reader. If the caller doesn't have a
+// seekable ciphertext source (e.g. a network response body), use DecryptReader
+// instead.
+func (ef *EncryptedFile) DecryptStream(src io.ReadSeeker) (io.Reader, error) {
+	if err := ef.checkVersion(); err != nil {
+		return nil, err
 	} else if ef.Key.Algorithm != "A256CTR" {
 		return nil, UnsupportedAlgorithm
-	} else if !ef.checkHash(ciphertext) {
+	} else if err := ef.decodeKeys(); err != nil {
+		return nil, err
+	}
+	expectedHash, err := ef.decodedHash()
+	if err != nil {
+		return nil, HashMismatch
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h.Sum(nil), expectedHash) {
+		return nil, HashMismatch
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(ef.decoded.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return &cipher.StreamReader{S: cipher.NewCTR(block, ef.decoded.iv[:]), R: src}, nil
+}
+
+// hashVerifyReader decrypts ciphertext on the fly while maintaining a running
+// SHA-256 of the ciphertext. The hash is only known to be correct once the
+// underlying reader is exhausted, so a mismatch is only detected on the Read
+// call that reaches EOF; until then, already-returned plaintext must be
+// treated as unverified by the caller.
+type hashVerifyReader struct {
+	cipher.StreamReader
+	ef   *EncryptedFile
+	hash hash.Hash
+}
+
+func (r *hashVerifyReader) Read(plaintext []byte) (int, error) {
+	n, err := r.StreamReader.Read(plaintext)
+	if err == io.EOF {
+		expectedHash, hashErr := r.ef.decodedHash()
+		if hashErr != nil || !bytes.Equal(r.hash.Sum(nil), expectedHash) {
+			return n, HashMismatch
+		}
+	}
+	return n, err
+}
+
+// DecryptReader returns a reader that decrypts src on the fly without
+// requiring it to be seekable. Unlike DecryptStream, the SHA-256 hash of the
+// ciphertext is verified incrementally and is only confirmed once the final
+// Read call reaches EOF; if the hash doesn't match, that final Read returns
+// HashMismatch instead of io.EOF. The caller is responsible for discarding
+// any plaintext already produced if HashMismatch is returned.
+func (ef *EncryptedFile) DecryptReader(src io.Reader) (io.Reader, error) {
+	if err := ef.checkVersion(); err != nil {
+		return nil, err
+	} else if ef.Key.Algorithm != "A256CTR" {
+		return nil, UnsupportedAlgorithm
+	} else if _, err := ef.decodedHash(); err != nil {
 		return nil, HashMismatch
 	} else if err := ef.decodeKeys(); err != nil {
 		return nil, err
-	} else {
-		return xorA256CTR(ciphertext, ef.decoded.key, ef.decoded.iv), nil
 	}
+	block, err := aes.NewCipher(ef.decoded.key[:])
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	return &hashVerifyReader{
+		StreamReader: cipher.StreamReader{S: cipher.NewCTR(block, ef.decoded.iv[:]), R: io.TeeReader(src, h)},
+		ef:           ef,
+		hash:         h,
+	}, nil
 }
 
-func xorA256CTR(source []byte, key [keyLength]byte, iv [ivLength]byte) []byte {
-	block, _ := aes.NewCipher(key[:])
-	result := make([]byte, len(source))
-	cipher.NewCTR(block, iv[:]).XORKeyStream(result, source)
-	return result
+// decodedHash decodes ef.Hashes.SHA256, accepting the same set of base64
+// alphabets as decodeKeys for compatibility with archived v1 attachments.
+func (ef *EncryptedFile) decodedHash() ([]byte, error) {
+	return decodeFlexible(ef.Hashes.SHA256, base64.RawStdEncoding, hashLength)
 }
 
 func genA256CTR() (key [keyLength]byte, iv [ivLength]byte) {
@@ -0,0 +1,126 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package attachment
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"testing"
+)
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	ef := NewEncryptedFile()
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+	ciphertext := ef.Encrypt(plaintext)
+	decrypted, err := ef.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("decrypted plaintext does not match: %q != %q", decrypted, plaintext)
+	}
+}
+
+func TestEncryptStreamDecryptStreamRoundTrip(t *testing.T) {
+	ef := NewEncryptedFile()
+	plaintext := []byte("streamed plaintext")
+	var ciphertext bytes.Buffer
+	w, err := ef.EncryptStream(&ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	} else if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ef.DecryptStream(bytes.NewReader(ciphertext.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("decrypted plaintext does not match: %q != %q", decrypted, plaintext)
+	}
+}
+
+func TestDecryptRejectsTamperedCiphertext(t *testing.T) {
+	ef := NewEncryptedFile()
+	ciphertext := ef.Encrypt([]byte("the quick brown fox jumps over the lazy dog"))
+	ciphertext[0] ^= 0xff
+	if _, err := ef.Decrypt(ciphertext); err != HashMismatch {
+		t.Fatalf("expected HashMismatch, got %v", err)
+	}
+}
+
+func TestDecryptReaderRejectsTamperedCiphertext(t *testing.T) {
+	ef := NewEncryptedFile()
+	ciphertext := ef.Encrypt([]byte("the quick brown fox jumps over the lazy dog"))
+	ciphertext[0] ^= 0xff
+	r, err := ef.DecryptReader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(r); err != HashMismatch {
+		t.Fatalf("expected HashMismatch, got %v", err)
+	}
+}
+
+func TestDecryptAcceptsV1AndVersionless(t *testing.T) {
+	for _, version := range []string{"v1", ""} {
+		ef := NewEncryptedFile()
+		ciphertext := ef.Encrypt([]byte("legacy attachment"))
+		ef.Version = version
+		decrypted, err := ef.Decrypt(ciphertext)
+		if err != nil {
+			t.Fatalf("version %q: %v", version, err)
+		}
+		if !bytes.Equal(decrypted, []byte("legacy attachment")) {
+			t.Fatalf("version %q: decrypted plaintext does not match", version)
+		}
+	}
+}
+
+func TestDecryptRejectsUnknownVersion(t *testing.T) {
+	ef := NewEncryptedFile()
+	ciphertext := ef.Encrypt([]byte("legacy attachment"))
+	ef.Version = "v3"
+	if _, err := ef.Decrypt(ciphertext); err != UnsupportedVersion {
+		t.Fatalf("expected UnsupportedVersion, got %v", err)
+	}
+}
+
+func TestDecryptAcceptsPermissiveBase64(t *testing.T) {
+	ef := NewEncryptedFile()
+	ciphertext := ef.Encrypt([]byte("legacy attachment"))
+	ef.Version = "v1"
+
+	rawIV, err := base64.RawStdEncoding.DecodeString(ef.InitVector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef.InitVector = base64.StdEncoding.EncodeToString(rawIV)
+
+	rawHash, err := base64.RawStdEncoding.DecodeString(ef.Hashes.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef.Hashes.SHA256 = base64.URLEncoding.EncodeToString(rawHash)
+
+	ef.decoded = nil
+	decrypted, err := ef.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, []byte("legacy attachment")) {
+		t.Fatal("decrypted plaintext does not match")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package attachment
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/go-jose/go-jose.v2"
+)
+
+// wrappedKeyPayload is the JWE plaintext produced by WrapJWE: everything a
+// recipient needs to decrypt the attachment ciphertext, without the
+// ciphertext itself (which stays on Matrix's media repo).
+type wrappedKeyPayload struct {
+	Key        JSONWebKey          `json:"key"`
+	InitVector string              `json:"iv"`
+	Hashes     EncryptedFileHashes `json:"hashes"`
+}
+
+// WrapJWE serializes ef's key material (JWK + IV + hashes, but not the
+// ciphertext) into a standards-compliant compact JWE encrypted to pub. This
+// lets a bridge or external service that owns a long-lived RSA or EC key
+// receive an attachment key without any Matrix-specific code or without
+// joining the room: the attachment ciphertext never leaves Matrix's media
+// repo, only the key travels, wrapped for pub.
+//
+// pub must be an *rsa.PublicKey (wrapped with RSA-OAEP-256) or an
+// *ecdsa.PublicKey (wrapped with ECDH-ES+A256KW). The payload itself is
+// encrypted with A256GCM, the closest standard JOSE content encryption to
+// the A256CTR used for the attachment; go-jose has no registered "A256CTR"
+// content encryption algorithm.
+func (ef *EncryptedFile) WrapJWE(pub interface{}) (string, error) {
+	alg := jose.RSA_OAEP_256
+	if _, ok := pub.(*ecdsa.PublicKey); ok {
+		alg = jose.ECDH_ES_A256KW
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: pub}, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create JWE encrypter: %w", err)
+	}
+	payload, err := json.Marshal(&wrappedKeyPayload{Key: ef.Key, InitVector: ef.InitVector, Hashes: ef.Hashes})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal key payload: %w", err)
+	}
+	jwe, err := encrypter.Encrypt(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt JWE: %w", err)
+	}
+	return jwe.CompactSerialize()
+}
+
+// UnwrapJWE decrypts a compact JWE produced by WrapJWE using priv (an
+// *rsa.PrivateKey or *ecdsa.PrivateKey matching the public key WrapJWE was
+// called with) and returns the EncryptedFile it describes. The returned
+// EncryptedFile decrypts the attachment ciphertext exactly like any other
+// Matrix v2 attachment; only the key travelled out-of-band.
+func UnwrapJWE(compact string, priv interface{}) (*EncryptedFile, error) {
+	jwe, err := jose.ParseEncrypted(compact)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWE: %w", err)
+	}
+	payload, err := jwe.Decrypt(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt JWE: %w", err)
+	}
+	var wrapped wrappedKeyPayload
+	if err = json.Unmarshal(payload, &wrapped); err != nil {
+		return nil, fmt.Errorf("failed to parse key payload: %w", err)
+	}
+	return &EncryptedFile{
+		Key:        wrapped.Key,
+		InitVector: wrapped.InitVector,
+		Hashes:     wrapped.Hashes,
+		Version:    "v2",
+	}, nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package attachment
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestWrapUnwrapJWERSA(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef := NewEncryptedFile()
+
+	compact, err := ef.WrapJWE(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := UnwrapJWE(compact, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped.Key.Key != ef.Key.Key || unwrapped.InitVector != ef.InitVector || unwrapped.Hashes.SHA256 != ef.Hashes.SHA256 {
+		t.Fatal("unwrapped EncryptedFile does not match the original")
+	}
+}
+
+func TestWrapUnwrapJWEECDSA(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef := NewEncryptedFile()
+
+	compact, err := ef.WrapJWE(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := UnwrapJWE(compact, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped.Key.Key != ef.Key.Key {
+		t.Fatal("unwrapped EncryptedFile does not match the original")
+	}
+}
+
+func TestUnwrapJWERejectsWrongKey(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef := NewEncryptedFile()
+
+	compact, err := ef.WrapJWE(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnwrapJWE(compact, other); err == nil {
+		t.Fatal("expected UnwrapJWE to fail with the wrong private key")
+	}
+}
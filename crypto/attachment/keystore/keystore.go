@@ -0,0 +1,320 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package keystore wraps attachment.EncryptedFile key material under a
+// user-supplied passphrase, producing a self-contained JSON blob that can be
+// stored outside the homeserver for disaster recovery of media keys. The
+// format is modeled on the Ethereum keystore v3 file: PBKDF2 (or, optionally,
+// scrypt) derives a wrapping key from the passphrase, half of which encrypts
+// the marshalled EncryptedFile with AES-128-CTR and half of which
+// authenticates the ciphertext with HMAC-SHA256.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+
+	"maunium.net/go/gomuks/crypto/attachment"
+)
+
+const (
+	aesKeyLength      = 16
+	macKeyLength      = 16
+	wrappingKeyLength = aesKeyLength + macKeyLength
+	saltLength        = 16
+
+	// DefaultPBKDF2Iterations is used by WrapWithPassphrase. It is below the
+	// current OWASP recommendation of 600,000 for PBKDF2-HMAC-SHA256, but
+	// 2^18 matches what Ethereum keystores have used for years and keeps
+	// unwrap fast.
+	DefaultPBKDF2Iterations = 262144
+
+	keystoreVersion = 3
+	cipherName      = "aes-128-ctr"
+
+	// maxPBKDF2Iterations, maxScryptLogN, maxScryptMemoryBytes and maxScryptP
+	// bound the cost UnwrapWithPassphrase will pay for a blob's kdfparams
+	// before it has had a chance to check the MAC. Without a ceiling, a
+	// crafted blob with e.g. c=2_000_000_000 could burn CPU, and N/r chosen
+	// independently (scrypt.Key allocates roughly 128*N*r bytes) could force a
+	// multi-gigabyte allocation, all for a hash that was never going to
+	// match. The limits are well above what WrapWithPassphraseOptions ever
+	// produces by default, so they shouldn't reject any blob this package
+	// itself wrote.
+	maxPBKDF2Iterations = 10_000_000
+	maxScryptLogN       = 22 // N must still be a power of two <= 1<<22
+
+	// maxScryptR bounds r directly so it can never be large enough to
+	// overflow the N*r*128 multiplication in the joint memory check below
+	// (an untrusted r close to math.MaxInt64 would otherwise wrap that
+	// multiplication around to a small or negative number and sail through).
+	maxScryptR = 64
+
+	// maxScryptMemoryBytes bounds N*r*128, the buffer scrypt.Key allocates.
+	// 512 MiB comfortably covers WrapWithPassphraseOptions's own default
+	// (N=1<<18, r=8 -> 256 MiB) while staying far short of an allocation that
+	// would hang or OOM-kill the caller.
+	maxScryptMemoryBytes = 512 * 1024 * 1024
+	// maxScryptP bounds p, which multiplies CPU cost without adding to the
+	// N*r memory bound above.
+	maxScryptP = 16
+)
+
+var (
+	ErrUnsupportedVersion  = errors.New("unsupported keystore version")
+	ErrUnsupportedCipher   = errors.New("unsupported keystore cipher")
+	ErrUnsupportedKDF      = errors.New("unsupported keystore kdf")
+	ErrKDFParamsOutOfRange = errors.New("keystore kdf parameters exceed the allowed range")
+	ErrMACMismatch         = errors.New("keystore mac does not match (wrong passphrase or corrupted file)")
+)
+
+// KDF selects the key derivation function used to stretch the passphrase
+// into a wrapping key.
+type KDF string
+
+const (
+	KDFPBKDF2 KDF = "pbkdf2"
+	KDFScrypt KDF = "scrypt"
+)
+
+// Options controls how a keystore blob derives its wrapping key. The zero
+// value selects PBKDF2 with DefaultPBKDF2Iterations.
+type Options struct {
+	KDF KDF
+
+	// PBKDF2Iterations is only used when KDF is KDFPBKDF2. Defaults to
+	// DefaultPBKDF2Iterations if zero.
+	PBKDF2Iterations int
+
+	// ScryptN, ScryptR and ScryptP are only used when KDF is KDFScrypt.
+	// They default to N=1<<18, r=8, p=1 if zero, matching scrypt's own
+	// recommended interactive parameters.
+	ScryptN, ScryptR, ScryptP int
+}
+
+func (o Options) withDefaults() Options {
+	if o.KDF == "" {
+		o.KDF = KDFPBKDF2
+	}
+	if o.PBKDF2Iterations == 0 {
+		o.PBKDF2Iterations = DefaultPBKDF2Iterations
+	}
+	if o.ScryptN == 0 {
+		o.ScryptN = 1 << 18
+	}
+	if o.ScryptR == 0 {
+		o.ScryptR = 8
+	}
+	if o.ScryptP == 0 {
+		o.ScryptP = 1
+	}
+	return o
+}
+
+type cipherParams struct {
+	IV string `json:"iv"`
+}
+
+type kdfParams struct {
+	// pbkdf2
+	C     int    `json:"c,omitempty"`
+	PRF   string `json:"prf,omitempty"`
+	DKLen int    `json:"dklen"`
+	Salt  string `json:"salt"`
+
+	// scrypt
+	N int `json:"n,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+}
+
+type keystoreJSON struct {
+	Version      int          `json:"version"`
+	Cipher       string       `json:"cipher"`
+	CipherParams cipherParams `json:"cipherparams"`
+	Ciphertext   string       `json:"ciphertext"`
+	KDF          string       `json:"kdf"`
+	KDFParams    kdfParams    `json:"kdfparams"`
+	MAC          string       `json:"mac"`
+}
+
+// WrapWithPassphrase serializes ef and encrypts it with a key derived from
+// passphrase via PBKDF2-HMAC-SHA256 (DefaultPBKDF2Iterations rounds),
+// producing a self-contained JSON blob suitable for offline storage.
+func WrapWithPassphrase(ef *attachment.EncryptedFile, passphrase []byte) ([]byte, error) {
+	return WrapWithPassphraseOptions(ef, passphrase, Options{})
+}
+
+// WrapWithPassphraseOptions is like WrapWithPassphrase, but lets the caller
+// pick the KDF (and its parameters, e.g. to use scrypt instead of PBKDF2).
+func WrapWithPassphraseOptions(ef *attachment.EncryptedFile, passphrase []byte, opts Options) ([]byte, error) {
+	opts = opts.withDefaults()
+	plaintext, err := json.Marshal(ef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal encrypted file: %w", err)
+	}
+
+	salt := make([]byte, saltLength)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	wrappingKey, params, err := deriveKey(passphrase, salt, opts)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, macKey := wrappingKey[:aesKeyLength], wrappingKey[aesKeyLength:]
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plaintext)
+
+	blob := keystoreJSON{
+		Version:      keystoreVersion,
+		Cipher:       cipherName,
+		CipherParams: cipherParams{IV: hex.EncodeToString(iv)},
+		Ciphertext:   hex.EncodeToString(ciphertext),
+		KDF:          string(opts.KDF),
+		KDFParams:    params,
+		MAC:          hex.EncodeToString(computeMAC(macKey, ciphertext)),
+	}
+	return json.Marshal(&blob)
+}
+
+// UnwrapWithPassphrase parses blob and decrypts the EncryptedFile it
+// contains using passphrase. It returns ErrMACMismatch if passphrase is
+// wrong or the blob has been corrupted or tampered with.
+func UnwrapWithPassphrase(blob, passphrase []byte) (*attachment.EncryptedFile, error) {
+	var ks keystoreJSON
+	if err := json.Unmarshal(blob, &ks); err != nil {
+		return nil, fmt.Errorf("failed to parse keystore blob: %w", err)
+	} else if ks.Version != keystoreVersion {
+		return nil, ErrUnsupportedVersion
+	} else if ks.Cipher != cipherName {
+		return nil, ErrUnsupportedCipher
+	}
+
+	ciphertext, err := hex.DecodeString(ks.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	iv, err := hex.DecodeString(ks.CipherParams.IV)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode iv: %w", err)
+	}
+	salt, err := hex.DecodeString(ks.KDFParams.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode salt: %w", err)
+	}
+	mac, err := hex.DecodeString(ks.MAC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode mac: %w", err)
+	}
+
+	wrappingKey, err := deriveKeyFromParams(passphrase, salt, KDF(ks.KDF), ks.KDFParams)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, macKey := wrappingKey[:aesKeyLength], wrappingKey[aesKeyLength:]
+
+	if !hmac.Equal(mac, computeMAC(macKey, ciphertext)) {
+		return nil, ErrMACMismatch
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+
+	ef := &attachment.EncryptedFile{}
+	if err = json.Unmarshal(plaintext, ef); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted encrypted file: %w", err)
+	}
+	return ef, nil
+}
+
+func deriveKey(passphrase, salt []byte, opts Options) ([]byte, kdfParams, error) {
+	switch opts.KDF {
+	case KDFPBKDF2:
+		key := pbkdf2.Key(passphrase, salt, opts.PBKDF2Iterations, wrappingKeyLength, sha256.New)
+		return key, kdfParams{C: opts.PBKDF2Iterations, PRF: "hmac-sha256", DKLen: wrappingKeyLength, Salt: hex.EncodeToString(salt)}, nil
+	case KDFScrypt:
+		key, err := scrypt.Key(passphrase, salt, opts.ScryptN, opts.ScryptR, opts.ScryptP, wrappingKeyLength)
+		if err != nil {
+			return nil, kdfParams{}, fmt.Errorf("failed to derive key: %w", err)
+		}
+		return key, kdfParams{N: opts.ScryptN, R: opts.ScryptR, P: opts.ScryptP, DKLen: wrappingKeyLength, Salt: hex.EncodeToString(salt)}, nil
+	default:
+		return nil, kdfParams{}, ErrUnsupportedKDF
+	}
+}
+
+// deriveKeyFromParams derives the wrapping key for a blob parsed from
+// untrusted storage, so unlike deriveKey it must validate params against
+// maxPBKDF2Iterations/maxScryptLogN/maxScryptMemoryBytes/maxScryptP before
+// spending any CPU or memory on the KDF itself -- otherwise a crafted blob
+// could turn UnwrapWithPassphrase into a denial of service long before its
+// MAC is ever checked.
+func deriveKeyFromParams(passphrase, salt []byte, kdf KDF, params kdfParams) ([]byte, error) {
+	switch kdf {
+	case KDFPBKDF2:
+		if params.C <= 0 || params.C > maxPBKDF2Iterations {
+			return nil, ErrKDFParamsOutOfRange
+		}
+		return pbkdf2.Key(passphrase, salt, params.C, wrappingKeyLength, sha256.New), nil
+	case KDFScrypt:
+		if params.N <= 1 || params.N&(params.N-1) != 0 || params.N > 1<<maxScryptLogN {
+			return nil, ErrKDFParamsOutOfRange
+		} else if params.R <= 0 || params.R > maxScryptR || params.P <= 0 || params.P > maxScryptP {
+			// r is bounded directly (not just via the joint check below) so an
+			// attacker-chosen r can never be large enough to overflow the
+			// N*r*128 multiplication in that check and sail through as a
+			// result.
+			return nil, ErrKDFParamsOutOfRange
+		} else if params.N > maxScryptMemoryBytes/128/params.R {
+			// Bounding N and r independently still isn't enough on its own:
+			// scrypt.Key's working buffer is roughly 128*N*r bytes, so a blob
+			// could otherwise pass both individual checks above and still
+			// demand an allocation far larger than either bound alone
+			// suggests. Dividing rather than multiplying keeps this check
+			// itself overflow-free regardless of N/r.
+			return nil, ErrKDFParamsOutOfRange
+		}
+		key, err := scrypt.Key(passphrase, salt, params.N, params.R, params.P, wrappingKeyLength)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, ErrUnsupportedKDF
+	}
+}
+
+// computeMAC authenticates ciphertext with HMAC-SHA256 keyed by macKey, the
+// second half of the wrapping key derived from the passphrase.
+func computeMAC(macKey, ciphertext []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(ciphertext)
+	return mac.Sum(nil)
+}
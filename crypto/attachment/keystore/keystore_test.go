@@ -0,0 +1,176 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package keystore
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"maunium.net/go/gomuks/crypto/attachment"
+)
+
+// knownAnswerBlob was generated independently (PBKDF2-HMAC-SHA256, c=1000,
+// fixed salt/iv, passphrase "correct horse battery staple") against a fixed
+// EncryptedFile plaintext, so any implementation following the documented
+// v3-keystore format (PBKDF2/scrypt -> AES-128-CTR + HMAC-SHA256 keyed by
+// mac_key over the ciphertext) should be able to read it back identically.
+const knownAnswerBlob = `{
+	"version": 3,
+	"cipher": "aes-128-ctr",
+	"cipherparams": {"iv": "101112131415161718191a1b1c1d1e1f"},
+	"ciphertext": "89b1cbe792e4fcfe1fcf8a23c5b6786b58845fd84a3d4da0eeaeb7e3c4cc91a1e8024d18d8a4c720910ef90212a6c74abf85c88c4a4b6f56a0fe81bbb9ae2aff6db71a4bc324a38963e31f3472c41a3fa1f439245d26a5f1c284f499fa9105c361df800b592784a4b2cd054cf7ca6759cee5c909167563d4d4e7aeaf0c6e08f6c8372a7992d6a804eaddab254c5ac101f25bd36a7aa556c0b3c368ba552f945ddc93b40e0215b30f9b1f692ade5e0f51ff33b1b01e94b447e07bebd62bd8b64398437259c248cb230e02e67e1f04f2f07827c9c94c3b2bf7b52a5ee820d3cf25e3b65a40fde3dc156ee6b8",
+	"kdf": "pbkdf2",
+	"kdfparams": {"c": 1000, "dklen": 32, "prf": "hmac-sha256", "salt": "000102030405060708090a0b0c0d0e0f"},
+	"mac": "a5cd2f08ae38fd0c94feeb981c800d2476e12b16737b91f040c35d54f122bcfe"
+}`
+
+const knownAnswerPassphrase = "correct horse battery staple"
+
+func knownAnswerEncryptedFile() *attachment.EncryptedFile {
+	return &attachment.EncryptedFile{
+		Key: attachment.JSONWebKey{
+			Key:         "YRGNq1sVzC0dGLhKJrjKuAqNk8ZdNrSJ1yXVlKJlEg0",
+			Algorithm:   "A256CTR",
+			Extractable: true,
+			KeyType:     "oct",
+			KeyOps:      []string{"encrypt", "decrypt"},
+		},
+		InitVector: "BcA/syaGHkcAAAAAAAAAAA",
+		Hashes:     attachment.EncryptedFileHashes{SHA256: "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"},
+		Version:    "v2",
+	}
+}
+
+func TestUnwrapKnownAnswerVector(t *testing.T) {
+	ef, err := UnwrapWithPassphrase([]byte(knownAnswerBlob), []byte(knownAnswerPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := knownAnswerEncryptedFile()
+	if ef.Key.Key != want.Key.Key || ef.InitVector != want.InitVector || ef.Hashes.SHA256 != want.Hashes.SHA256 || ef.Version != want.Version {
+		t.Fatalf("unwrapped EncryptedFile does not match the known-answer vector: %+v", ef)
+	}
+}
+
+func TestUnwrapKnownAnswerVectorWrongPassphrase(t *testing.T) {
+	_, err := UnwrapWithPassphrase([]byte(knownAnswerBlob), []byte("wrong passphrase"))
+	if err != ErrMACMismatch {
+		t.Fatalf("expected ErrMACMismatch, got %v", err)
+	}
+}
+
+func TestUnwrapKnownAnswerVectorTamperedCiphertext(t *testing.T) {
+	tampered := strings.Replace(knownAnswerBlob, `"ciphertext": "89b1`, `"ciphertext": "89b0`, 1)
+	if tampered == knownAnswerBlob {
+		t.Fatal("test setup did not actually tamper with the ciphertext")
+	}
+	_, err := UnwrapWithPassphrase([]byte(tampered), []byte(knownAnswerPassphrase))
+	if err != ErrMACMismatch {
+		t.Fatalf("expected ErrMACMismatch, got %v", err)
+	}
+}
+
+func TestWrapUnwrapPassphraseRoundTrip(t *testing.T) {
+	ef := knownAnswerEncryptedFile()
+	blob, err := WrapWithPassphrase(ef, []byte(knownAnswerPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := UnwrapWithPassphrase(blob, []byte(knownAnswerPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped.Key.Key != ef.Key.Key || unwrapped.InitVector != ef.InitVector {
+		t.Fatal("round-tripped EncryptedFile does not match")
+	}
+}
+
+func TestWrapUnwrapPassphraseScryptRoundTrip(t *testing.T) {
+	ef := knownAnswerEncryptedFile()
+	blob, err := WrapWithPassphraseOptions(ef, []byte(knownAnswerPassphrase), Options{KDF: KDFScrypt, ScryptN: 1 << 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := UnwrapWithPassphrase(blob, []byte(knownAnswerPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped.Key.Key != ef.Key.Key {
+		t.Fatal("round-tripped EncryptedFile does not match")
+	}
+}
+
+func TestUnwrapRejectsOversizedKDFParams(t *testing.T) {
+	var ks keystoreJSON
+	if err := json.Unmarshal([]byte(knownAnswerBlob), &ks); err != nil {
+		t.Fatal(err)
+	}
+	ks.KDFParams.C = maxPBKDF2Iterations + 1
+	blob, err := json.Marshal(&ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnwrapWithPassphrase(blob, []byte(knownAnswerPassphrase)); err != ErrKDFParamsOutOfRange {
+		t.Fatalf("expected ErrKDFParamsOutOfRange, got %v", err)
+	}
+}
+
+func TestUnwrapRejectsScryptParamsThatExceedMemoryBoundJointly(t *testing.T) {
+	var ks keystoreJSON
+	if err := json.Unmarshal([]byte(knownAnswerBlob), &ks); err != nil {
+		t.Fatal(err)
+	}
+	ks.KDF = string(KDFScrypt)
+	// N and r each individually satisfy their own caps (N <= 1<<maxScryptLogN,
+	// r <= maxScryptR), but together they'd force scrypt.Key to allocate
+	// ~32 GiB (128*N*r bytes) before the MAC is ever checked.
+	ks.KDFParams.N, ks.KDFParams.R, ks.KDFParams.P = 1<<22, 64, 1
+	blob, err := json.Marshal(&ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnwrapWithPassphrase(blob, []byte(knownAnswerPassphrase)); err != ErrKDFParamsOutOfRange {
+		t.Fatalf("expected ErrKDFParamsOutOfRange, got %v", err)
+	}
+}
+
+func TestUnwrapRejectsOverflowSizedScryptR(t *testing.T) {
+	var ks keystoreJSON
+	if err := json.Unmarshal([]byte(knownAnswerBlob), &ks); err != nil {
+		t.Fatal(err)
+	}
+	ks.KDF = string(KDFScrypt)
+	// A r this large would overflow an N*r*128 multiplication (wrapping to a
+	// small or negative number and sailing through a naive joint check), so
+	// this must be rejected by the independent r <= maxScryptR bound instead.
+	ks.KDFParams.N, ks.KDFParams.R, ks.KDFParams.P = 1<<22, math.MaxInt64, 1
+	blob, err := json.Marshal(&ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnwrapWithPassphrase(blob, []byte(knownAnswerPassphrase)); err != ErrKDFParamsOutOfRange {
+		t.Fatalf("expected ErrKDFParamsOutOfRange, got %v", err)
+	}
+}
+
+func TestUnwrapRejectsNonPowerOfTwoScryptN(t *testing.T) {
+	var ks keystoreJSON
+	if err := json.Unmarshal([]byte(knownAnswerBlob), &ks); err != nil {
+		t.Fatal(err)
+	}
+	ks.KDF = string(KDFScrypt)
+	ks.KDFParams.N, ks.KDFParams.R, ks.KDFParams.P = 12345, 8, 1
+	blob, err := json.Marshal(&ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnwrapWithPassphrase(blob, []byte(knownAnswerPassphrase)); err != ErrKDFParamsOutOfRange {
+		t.Fatalf("expected ErrKDFParamsOutOfRange, got %v", err)
+	}
+}
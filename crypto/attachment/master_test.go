@@ -0,0 +1,58 @@
+// Copyright (c) 2026 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package attachment
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNewEncryptedFileFromMasterRoundTrip(t *testing.T) {
+	master := []byte("room-scoped master secret")
+	ef := NewEncryptedFileFromMaster(master, []byte("!room:example.org/$event/0"))
+	plaintext := []byte("attachment derived from a master secret")
+	ciphertext := ef.Encrypt(plaintext)
+
+	decrypted, err := ef.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("decrypted plaintext does not match")
+	}
+}
+
+func TestNewEncryptedFileFromMasterIsDeterministic(t *testing.T) {
+	master := []byte("room-scoped master secret")
+	info := []byte("!room:example.org/$event/0")
+	a := NewEncryptedFileFromMaster(master, info)
+	b := NewEncryptedFileFromMaster(master, info)
+	if a.Key.Key != b.Key.Key || a.InitVector != b.InitVector {
+		t.Fatal("expected the same master+info pair to derive the same key+iv")
+	}
+
+	c := NewEncryptedFileFromMaster(master, []byte("!room:example.org/$event/1"))
+	if a.Key.Key == c.Key.Key {
+		t.Fatal("expected different info to derive a different key")
+	}
+}
+
+func TestIVReuseCheckPanicsOnReusedInfo(t *testing.T) {
+	IVReuseCheck = true
+	defer func() { IVReuseCheck = false }()
+
+	master := []byte("room-scoped master secret")
+	info := []byte("!room:example.org/$event/only-used-once")
+	NewEncryptedFileFromMaster(master, info)
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected NewEncryptedFileFromMaster to panic on reused master+info")
+		}
+	}()
+	NewEncryptedFileFromMaster(master, info)
+}